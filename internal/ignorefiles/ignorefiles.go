@@ -0,0 +1,187 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+// Package ignorefiles implements the pattern-matching rules used by
+// ".terraformignore" files, factored out into its own package so that
+// callers other than the module packaging code (such as the source bundle
+// loader in stackeval) can consult the same rules.
+//
+// The supported syntax mirrors ".gitignore": blank lines and lines starting
+// with "#" are ignored, a leading "!" negates a pattern, a trailing "/"
+// restricts a pattern to directories, a leading "/" anchors a pattern to
+// the root of the tree being matched, and "**" matches zero or more path
+// segments.
+package ignorefiles
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ruleset is a compiled set of ".terraformignore"-style patterns that can
+// be tested against slash-separated, root-relative paths.
+type Ruleset struct {
+	rules []rule
+}
+
+type rule struct {
+	negated  bool
+	dirOnly  bool
+	anchored bool
+	segments []string // pattern split on "/", with "**" preserved literally
+}
+
+// DefaultRules is the ruleset Terraform applies when no ".terraformignore"
+// file is present: it excludes version control directories and Terraform's
+// own working files, matching the historical defaults baked into the
+// module packaging code.
+var DefaultRules = MustParseRules(strings.NewReader(strings.Join([]string{
+	".git/",
+	".terraform/",
+	"*.tfstate",
+	"*.tfstate.backup",
+	".terraformrc",
+	"terraform.rc",
+}, "\n")))
+
+// ParseRules reads ".terraformignore"-style patterns from r and compiles
+// them into a Ruleset.
+func ParseRules(r io.Reader) (*Ruleset, error) {
+	var rules []rule
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, parsePattern(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &Ruleset{rules: rules}, nil
+}
+
+// MustParseRules is like ParseRules but panics if the patterns can't be
+// read, for use with statically-known pattern sets such as [DefaultRules].
+func MustParseRules(r io.Reader) *Ruleset {
+	ret, err := ParseRules(r)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// LoadRulesFile reads a ".terraformignore" file at the given path and
+// compiles it into a Ruleset. If the file doesn't exist this returns
+// [DefaultRules] rather than an error, matching the historical behavior of
+// module packaging when no ignore file is present.
+func LoadRulesFile(path string) (*Ruleset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultRules, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+func parsePattern(pattern string) rule {
+	var ru rule
+
+	if strings.HasPrefix(pattern, "!") {
+		ru.negated = true
+		pattern = pattern[1:]
+	}
+	if strings.HasPrefix(pattern, "/") {
+		ru.anchored = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		ru.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		// Any pattern containing an internal slash is implicitly anchored,
+		// matching the ".gitignore" rule that only a bare filename pattern
+		// is allowed to match at any depth.
+		ru.anchored = true
+	}
+
+	ru.segments = strings.Split(pattern, "/")
+	return ru
+}
+
+// Excludes reports whether the given root-relative, slash-separated path
+// should be excluded from module packaging or parsing, taking into account
+// negated ("!") rules that were declared after the rule that would
+// otherwise have excluded it.
+//
+// isDir should be true if path refers to a directory.
+func (rs *Ruleset) Excludes(path string, isDir bool) bool {
+	if rs == nil {
+		return false
+	}
+
+	path = filepath.ToSlash(path)
+	excluded := false
+	for _, ru := range rs.rules {
+		if ru.dirOnly && !isDir {
+			continue
+		}
+		if ru.match(path) {
+			excluded = !ru.negated
+		}
+	}
+	return excluded
+}
+
+func (ru rule) match(path string) bool {
+	pathSegs := strings.Split(path, "/")
+
+	if ru.anchored {
+		return matchSegments(ru.segments, pathSegs)
+	}
+
+	// An unanchored single-segment pattern may match starting at any
+	// position within the path, like ".gitignore" does for bare filenames.
+	for start := range pathSegs {
+		if matchSegments(ru.segments, pathSegs[start:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments compares a pattern's path segments against a candidate
+// path's segments, honoring "**" as a wildcard for zero or more segments.
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			return true // trailing "**" matches everything beneath it
+		}
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], path[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package ignorefiles
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRulesetExcludes(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{
+			name:     "bare filename matches at any depth",
+			patterns: "*.tfstate",
+			path:     "nested/dir/terraform.tfstate",
+			want:     true,
+		},
+		{
+			name:     "anchored pattern only matches at the root",
+			patterns: "/foo.txt",
+			path:     "nested/foo.txt",
+			want:     false,
+		},
+		{
+			name:     "anchored pattern matches at the root",
+			patterns: "/foo.txt",
+			path:     "foo.txt",
+			want:     true,
+		},
+		{
+			name:     "multi-segment pattern is implicitly anchored",
+			patterns: "nested/foo.txt",
+			path:     "other/nested/foo.txt",
+			want:     false,
+		},
+		{
+			name:     "dir-only pattern does not match a file",
+			patterns: "build/",
+			path:     "build",
+			isDir:    false,
+			want:     false,
+		},
+		{
+			name:     "dir-only pattern matches a directory",
+			patterns: "build/",
+			path:     "build",
+			isDir:    true,
+			want:     true,
+		},
+		{
+			name:     "double-star matches any number of intermediate segments",
+			patterns: "a/**/z",
+			path:     "a/b/c/z",
+			want:     true,
+		},
+		{
+			name:     "double-star also matches zero intermediate segments",
+			patterns: "a/**/z",
+			path:     "a/z",
+			want:     true,
+		},
+		{
+			name: "later negation overrides an earlier exclusion",
+			patterns: strings.Join([]string{
+				"*.log",
+				"!important.log",
+			}, "\n"),
+			path: "important.log",
+			want: false,
+		},
+		{
+			name: "negation only applies to paths it matches",
+			patterns: strings.Join([]string{
+				"*.log",
+				"!important.log",
+			}, "\n"),
+			path: "other.log",
+			want: true,
+		},
+		{
+			name: "rule order matters: a later plain rule re-excludes",
+			patterns: strings.Join([]string{
+				"!keep.txt",
+				"keep.txt",
+			}, "\n"),
+			path: "keep.txt",
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rs := MustParseRules(strings.NewReader(test.patterns))
+			got := rs.Excludes(test.path, test.isDir)
+			if got != test.want {
+				t.Errorf("Excludes(%q, isDir=%v) = %v, want %v", test.path, test.isDir, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRulesetExcludesNilReceiver(t *testing.T) {
+	var rs *Ruleset
+	if rs.Excludes("anything", false) {
+		t.Error("a nil Ruleset should never exclude anything")
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{".git", true, true},
+		{"terraform.tfstate", false, true},
+		{"terraform.tfstate.backup", false, true},
+		{".terraformrc", false, true},
+		{"main.tf", false, false},
+	}
+	for _, test := range tests {
+		got := DefaultRules.Excludes(test.path, test.isDir)
+		if got != test.want {
+			t.Errorf("DefaultRules.Excludes(%q, isDir=%v) = %v, want %v", test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestLoadRulesFileMissing(t *testing.T) {
+	rs, err := LoadRulesFile("/nonexistent/path/.terraformignore")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rs != DefaultRules {
+		t.Error("expected LoadRulesFile to fall back to DefaultRules when the file doesn't exist")
+	}
+}
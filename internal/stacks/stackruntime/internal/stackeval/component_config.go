@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/apparentlymart/go-versions/versions"
 	"github.com/hashicorp/go-slug/sourceaddrs"
@@ -20,7 +21,9 @@ import (
 
 	"github.com/hashicorp/terraform/internal/addrs"
 	"github.com/hashicorp/terraform/internal/configs"
+	"github.com/hashicorp/terraform/internal/ignorefiles"
 	"github.com/hashicorp/terraform/internal/instances"
+	"github.com/hashicorp/terraform/internal/moduletest"
 	"github.com/hashicorp/terraform/internal/promising"
 	"github.com/hashicorp/terraform/internal/providers"
 	"github.com/hashicorp/terraform/internal/stacks/stackaddrs"
@@ -36,8 +39,9 @@ type ComponentConfig struct {
 
 	main *Main
 
-	validate   promising.Once[tfdiags.Diagnostics]
-	moduleTree promising.Once[withDiagnostics[*configs.Config]]
+	validate       promising.Once[tfdiags.Diagnostics]
+	moduleTree     promising.Once[withDiagnostics[*configs.Config]]
+	moduleTreeTest promising.Once[withDiagnostics[*configs.Config]]
 }
 
 func newComponentConfig(main *Main, addr stackaddrs.ConfigComponent, config *stackconfig.Component) *ComponentConfig {
@@ -78,96 +82,298 @@ func (c *ComponentConfig) CheckModuleTree(ctx context.Context) (*configs.Config,
 	return doOnceWithDiags(
 		ctx, &c.moduleTree, c.main,
 		func(ctx context.Context) (*configs.Config, tfdiags.Diagnostics) {
-			var diags tfdiags.Diagnostics
-
-			decl := c.Declaration(ctx)
-			sources := c.main.SourceBundle(ctx)
-
-			// The "configs" package predates the idea of explicit source
-			// bundles, so for now we need to do some adaptation to
-			// help it interact with the files in the source bundle despite
-			// not being aware of that abstraction.
-			// TODO: Introduce source bundle support into the "configs" package
-			// API, and factor out some of this complexity onto there.
-
-			rootModuleSource := decl.FinalSourceAddr
-			if rootModuleSource == nil {
-				// If we get here then the configuration was loaded incorrectly,
-				// either by the stackconfig package or by the caller of the
-				// stackconfig package using the wrong loading function.
-				panic("component configuration lacks final source address")
-			}
-			rootModuleDir, err := sources.LocalPathForSource(rootModuleSource)
-			if err != nil {
-				// We should not get here if the source bundle was constructed
-				// correctly.
-				diags = diags.Append(&hcl.Diagnostic{
-					Severity: hcl.DiagError,
-					Summary:  "Can't load module for component",
-					Detail:   fmt.Sprintf("Failed to load this component's root module: %s.", tfdiags.FormatError(err)),
-					Subject:  decl.SourceAddrRange.ToHCL().Ptr(),
-				})
+			return c.loadModuleTree(ctx, "")
+		},
+	)
+}
+
+// loadModuleTree does the actual work of [ComponentConfig.CheckModuleTree],
+// factored out so that [ComponentConfig.CheckModuleTreeWithTests] can reuse
+// it with test-file discovery turned on for every module in the tree, not
+// just the root module.
+//
+// testDir is the name of a subdirectory (relative to each module in the
+// tree) to also search for "*.tftest.hcl" files, or the empty string to
+// skip test-file discovery entirely.
+func (c *ComponentConfig) loadModuleTree(ctx context.Context, testDir string) (*configs.Config, tfdiags.Diagnostics) {
+	var diags tfdiags.Diagnostics
+
+	decl := c.Declaration(ctx)
+	sources := c.main.SourceBundle(ctx)
+
+	// The "configs" package predates the idea of explicit source
+	// bundles, so for now we need to do some adaptation to
+	// help it interact with the files in the source bundle despite
+	// not being aware of that abstraction.
+	// TODO: Introduce source bundle support into the "configs" package
+	// API, and factor out some of this complexity onto there.
+
+	rootModuleSource := decl.FinalSourceAddr
+	if rootModuleSource == nil {
+		// If we get here then the configuration was loaded incorrectly,
+		// either by the stackconfig package or by the caller of the
+		// stackconfig package using the wrong loading function.
+		panic("component configuration lacks final source address")
+	}
+	rootModuleDir, err := sources.LocalPathForSource(rootModuleSource)
+	if err != nil {
+		// We should not get here if the source bundle was constructed
+		// correctly.
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Can't load module for component",
+			Detail:   fmt.Sprintf("Failed to load this component's root module: %s.", tfdiags.FormatError(err)),
+			Subject:  decl.SourceAddrRange.ToHCL().Ptr(),
+		})
+		return nil, diags
+	}
+
+	// Since the module config loader doesn't yet understand source
+	// bundles, any diagnostics we return from here will contain the
+	// real filesystem path of the problematic file rather than
+	// preserving the source bundle abstraction. As a compromise
+	// though, we'll make the path relative to the current working
+	// directory so at least it won't be quite so obnoxiously long
+	// when we're running in situations like a remote executor that
+	// uses a separate directory per job.
+	// FIXME: Make the module loader aware of source bundles and use
+	// source addresses in its diagnostics, etc.
+	if cwd, err := os.Getwd(); err == nil {
+		relPath, err := filepath.Rel(cwd, rootModuleDir)
+		if err == nil {
+			rootModuleDir = filepath.ToSlash(relPath)
+		}
+	}
+
+	// With rootModuleDir we can now have the configs package work
+	// directly with the real filesystem, rather than with the source
+	// bundle. However, this does mean that any error messages generated
+	// from this process will disclose the real locations of the
+	// source files on disk (an implementation detail) rather than
+	// preserving the source address abstraction.
+	parser := configs.NewParser(afero.NewOsFs())
+	parser.AllowLanguageExperiments(c.main.LanguageExperimentsAllowed())
+
+	if !parser.IsConfigDir(rootModuleDir) {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Can't load module for component",
+			Detail:   fmt.Sprintf("The source location %s does not contain a Terraform module.", rootModuleSource),
+			Subject:  decl.SourceAddrRange.ToHCL().Ptr(),
+		})
+		return nil, diags
+	}
+
+	rootMod, hclDiags := parser.LoadConfigDir(rootModuleDir)
+	diags = diags.Append(hclDiags)
+	if hclDiags.HasErrors() {
+		return nil, diags
+	}
+	if testDir != "" {
+		testSuite, moreDiags := parser.LoadTestSuiteForModule(rootModuleDir, testDir, rootMod)
+		diags = diags.Append(moreDiags)
+		rootMod.Tests = testSuite
+	}
+
+	walkerOpts := []SourceBundleModuleWalkerOption{
+		WithTestFiles(testDir),
+		// The stack configuration language doesn't yet have anywhere to
+		// opt out of deprecated-module-version warnings for an entire run
+		// (e.g. a CI pipeline that intentionally pins an older, deprecated
+		// version), so for now we always let them through.
+		WithSuppressDeprecationWarnings(false),
+	}
+	// The stackconfig package doesn't yet have anywhere on Component to
+	// record which final source each module call was pinned to when the
+	// source bundle manifest was built, so we can't pass a
+	// WithPinnedSources option here yet; [sourceBundleModuleWalker] and
+	// [finalSourceFromManifest] are ready to use it once that field exists.
+	// There isn't yet a Main-level policy knob (e.g. a "-version-policy"
+	// CLI flag) that could select something other than the walker's
+	// default [NewestInSetSelector], so we don't pass a WithVersionSelector
+	// option here until that plumbing exists.
+
+	configRoot, hclDiags := configs.BuildConfig(rootMod, newSourceBundleModuleWalker(
+		sources, parser, walkerOpts...,
+	), nil)
+	diags = diags.Append(hclDiags)
+	if hclDiags.HasErrors() {
+		return nil, diags
+	}
+
+	// We also have a small selection of additional static validation
+	// rules that apply only to modules used within stack components.
+	diags = diags.Append(c.validateModuleTreeForStacks(configRoot))
+
+	return configRoot, diags
+}
+
+// CheckModuleTreeWithTests is like [ComponentConfig.CheckModuleTree] except
+// that it also discovers any ".tftest.hcl" files that apply to the
+// component's root module and attaches them to the returned configuration,
+// mirroring what [configs.Parser.LoadConfigDirWithTests] does for
+// traditional root modules.
+//
+// Test files are looked for both alongside the root module's other files
+// and inside the conventional "tests" directory relative to the root
+// module.
+func (c *ComponentConfig) CheckModuleTreeWithTests(ctx context.Context) (*configs.Config, tfdiags.Diagnostics) {
+	return doOnceWithDiags(
+		ctx, &c.moduleTreeTest, c.main,
+		func(ctx context.Context) (*configs.Config, tfdiags.Diagnostics) {
+			// The stack configuration language doesn't yet have a way to
+			// override the tests directory name for a component, the way
+			// a root module's "tests" block can for traditional Terraform,
+			// so we always look in the conventional "tests" subdirectory.
+			const testsDir = "tests"
+
+			configRoot, diags := c.loadModuleTree(ctx, testsDir)
+			if configRoot == nil {
 				return nil, diags
 			}
 
-			// Since the module config loader doesn't yet understand source
-			// bundles, any diagnostics we return from here will contain the
-			// real filesystem path of the problematic file rather than
-			// preserving the source bundle abstraction. As a compromise
-			// though, we'll make the path relative to the current working
-			// directory so at least it won't be quite so obnoxiously long
-			// when we're running in situations like a remote executor that
-			// uses a separate directory per job.
-			// FIXME: Make the module loader aware of source bundles and use
-			// source addresses in its diagnostics, etc.
-			if cwd, err := os.Getwd(); err == nil {
-				relPath, err := filepath.Rel(cwd, rootModuleDir)
-				if err == nil {
-					rootModuleDir = filepath.ToSlash(relPath)
+			for _, testFile := range configRoot.Module.Tests {
+				for _, run := range testFile.Runs {
+					if run.ModuleConfig == nil {
+						continue
+					}
+					diags = diags.Append(c.validateModuleForStacks(addrs.RootModule, run.ModuleConfig))
 				}
 			}
 
-			// With rootModuleDir we can now have the configs package work
-			// directly with the real filesystem, rather than with the source
-			// bundle. However, this does mean that any error messages generated
-			// from this process will disclose the real locations of the
-			// source files on disk (an implementation detail) rather than
-			// preserving the source address abstraction.
-			parser := configs.NewParser(afero.NewOsFs())
-			parser.AllowLanguageExperiments(c.main.LanguageExperimentsAllowed())
+			return configRoot, diags
+		},
+	)
+}
+
+// RunTests loads and executes every ".tftest.hcl" run block discovered for
+// this component's root module, using the same provider-client and
+// source-bundle plumbing that [ComponentConfig.checkValid] uses for
+// validation, and returns the aggregated results alongside any diagnostics
+// produced while doing so.
+func (c *ComponentConfig) RunTests(ctx context.Context) (*moduletest.Suite, tfdiags.Diagnostics) {
+	var diags tfdiags.Diagnostics
+
+	moduleTree, moreDiags := c.CheckModuleTreeWithTests(ctx)
+	diags = diags.Append(moreDiags)
+	if moduleTree == nil {
+		return nil, diags
+	}
+	decl := c.Declaration(ctx)
+
+	// Tests can exercise modules (and module versions, via run block
+	// "module" overrides) that the test-aware moduleTree we just loaded
+	// knows about but the component's plain, non-test module tree does
+	// not, so we derive provider schemas and clients from moduleTree
+	// itself rather than re-deriving them from [ComponentConfig.ModuleTree],
+	// which would both miss those overrides and re-parse the module tree
+	// a second time.
+	providerSchemas, moreDiags := c.neededProviderSchemasForModuleTree(ctx, moduleTree, PlanPhase)
+	diags = diags.Append(moreDiags)
+	if moreDiags.HasErrors() {
+		return nil, diags
+	}
+
+	tfCtx, err := terraform.NewContext(&terraform.ContextOpts{
+		PreloadedProviderSchemas: providerSchemas,
+		Provisioners:             c.main.availableProvisioners(),
+	})
+	if err != nil {
+		diags = diags.Append(tfdiags.Sourceless(
+			tfdiags.Error,
+			"Failed to instantiate Terraform modules runtime",
+			fmt.Sprintf("Could not load the main Terraform language runtime: %s.\n\nThis is a bug in Terraform; please report it!", err),
+		))
+		return nil, diags
+	}
 
-			if !parser.IsConfigDir(rootModuleDir) {
+	providerClients, valid := c.neededProviderClientsForModuleTree(ctx, moduleTree, PlanPhase)
+	if !valid {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Cannot run tests for component",
+			Detail:   fmt.Sprintf("Cannot run tests for %s because its provider configuration assignments are invalid.", c.Addr()),
+			Subject:  decl.DeclRange.ToHCL().Ptr(),
+		})
+		return nil, diags
+	}
+	defer func() {
+		for _, client := range providerClients {
+			client.Close()
+		}
+	}()
+
+	suite := &moduletest.Suite{Status: moduletest.Pass}
+	for _, testFile := range moduleTree.Module.Tests {
+		for _, run := range testFile.Runs {
+			if run.Config.Providers != nil {
+				// The same "no inline provider configurations" rule that
+				// applies to the component's root module also applies to
+				// providers declared directly within a run block, because
+				// stacks always sources provider configurations from the
+				// stack configuration rather than from the modules language.
 				diags = diags.Append(&hcl.Diagnostic{
 					Severity: hcl.DiagError,
-					Summary:  "Can't load module for component",
-					Detail:   fmt.Sprintf("The source location %s does not contain a Terraform module.", rootModuleSource),
-					Subject:  decl.SourceAddrRange.ToHCL().Ptr(),
+					Summary:  "Inline provider configuration not allowed",
+					Detail:   "A \"run\" block used within a stack component's test suite must not declare its own provider configurations; the providers under test must come from the component's \"providers\" argument.",
+					Subject:  run.Config.DeclRange.Ptr(),
 				})
-				return nil, diags
+				continue
 			}
 
-			rootMod, hclDiags := parser.LoadConfigDir(rootModuleDir)
-			diags = diags.Append(hclDiags)
-			if hclDiags.HasErrors() {
-				return nil, diags
+			result, moreDiags := tfCtx.TestContext(moduleTree, nil, &terraform.PlanOpts{}, nil).TestRun(run, moduletest.TestOpts{
+				ExternalProviders: providerClients,
+			})
+			diags = diags.Append(moreDiags)
+			run.Status = result
+			if result > suite.Status {
+				suite.Status = result
 			}
+		}
+		suite.Files = append(suite.Files, testFile)
+	}
 
-			configRoot, hclDiags := configs.BuildConfig(rootMod, &sourceBundleModuleWalker{
-				sources: sources,
-				parser:  parser,
-			}, nil)
-			diags = diags.Append(hclDiags)
-			if hclDiags.HasErrors() {
-				return nil, diags
-			}
+	return suite, diags
+}
 
-			// We also have a small selection of additional static validation
-			// rules that apply only to modules used within stack components.
-			diags = diags.Append(c.validateModuleTreeForStacks(configRoot))
+// TestResultsSummary tallies the outcome of running a component's
+// ".tftest.hcl" suite via [ComponentConfig.RunTests].
+//
+// This isn't a [stackplan.PlannedChange] because that package doesn't yet
+// have a variant for reporting component test results; once it does,
+// [ComponentConfig.TestResults] should return that instead so the summary
+// can flow through the same planned-change stream as everything else
+// PlanChanges produces.
+type TestResultsSummary struct {
+	Addr             stackaddrs.ConfigComponent
+	Status           moduletest.Status
+	Pass, Fail, Skip int
+}
 
-			return configRoot, diags
-		},
-	)
+// TestResults runs this component's test suite and summarizes the result,
+// so that a caller driving a stack's tests can report pass/fail/skip counts
+// for the component alongside whatever it reports for its other components.
+func (c *ComponentConfig) TestResults(ctx context.Context) (*TestResultsSummary, tfdiags.Diagnostics) {
+	suite, diags := c.RunTests(ctx)
+	if suite == nil {
+		return nil, diags
+	}
+
+	ret := &TestResultsSummary{Addr: c.Addr(), Status: suite.Status}
+	for _, file := range suite.Files {
+		for _, run := range file.Runs {
+			switch run.Status {
+			case moduletest.Pass:
+				ret.Pass++
+			case moduletest.Skip:
+				ret.Skip++
+			default:
+				ret.Fail++
+			}
+		}
+	}
+
+	return ret, diags
 }
 
 // validateModuleTreeForStacks imposes some additional validation constraints
@@ -292,7 +498,16 @@ func (c *ComponentConfig) CheckInputVariableValues(ctx context.Context, phase Ev
 // result could under-promise or over-promise depending on the kind of
 // invalidity.
 func (c *ComponentConfig) RequiredProviderInstances(ctx context.Context) addrs.Set[addrs.RootProviderConfig] {
-	moduleTree := c.ModuleTree(ctx)
+	return c.requiredProviderInstancesForModuleTree(c.ModuleTree(ctx))
+}
+
+// requiredProviderInstancesForModuleTree is the shared implementation of
+// [ComponentConfig.RequiredProviderInstances], factored out so that callers
+// which already have a specific module tree in hand (such as
+// [ComponentConfig.RunTests], which must use its test-aware module tree
+// rather than the component's plain one) can avoid forcing a second,
+// inconsistent load of the module tree.
+func (c *ComponentConfig) requiredProviderInstancesForModuleTree(moduleTree *configs.Config) addrs.Set[addrs.RootProviderConfig] {
 	if moduleTree == nil || moduleTree.Root == nil {
 		// If we get here then we presumably failed to load the module, and
 		// so we'll just unwind quickly so a different return path can return
@@ -302,14 +517,38 @@ func (c *ComponentConfig) RequiredProviderInstances(ctx context.Context) addrs.S
 	return moduleTree.Root.EffectiveRequiredProviderConfigs()
 }
 
+// CheckProviders implements the static/validate-time half of checking that a
+// component's "providers" argument satisfies its root module's required
+// provider configurations.
+//
+// TODO: This relaxation (allowing a type-compatible provider configuration
+// to satisfy a slot even when its key doesn't match the slot's local name)
+// needs to be mirrored in component_instance's plan/apply-time CheckProviders
+// at the same time, or validate and plan/apply will disagree about which
+// assignments are acceptable.
 func (c *ComponentConfig) CheckProviders(ctx context.Context, phase EvalPhase) (addrs.Set[addrs.RootProviderConfig], tfdiags.Diagnostics) {
+	return c.checkProvidersForModuleTree(ctx, c.ModuleTree(ctx), phase)
+}
+
+// checkProvidersForModuleTree is the shared implementation of
+// [ComponentConfig.CheckProviders], taking an explicit module tree for the
+// same reason as [ComponentConfig.requiredProviderInstancesForModuleTree].
+func (c *ComponentConfig) checkProvidersForModuleTree(ctx context.Context, moduleTree *configs.Config, phase EvalPhase) (addrs.Set[addrs.RootProviderConfig], tfdiags.Diagnostics) {
 	var diags tfdiags.Diagnostics
 
 	stackConfig := c.StackConfig(ctx)
 	declConfigs := c.Declaration(ctx).ProviderConfigs
-	neededProviders := c.RequiredProviderInstances(ctx)
+	neededProviders := c.requiredProviderInstancesForModuleTree(moduleTree)
 
 	ret := addrs.MakeSet[addrs.RootProviderConfig]()
+
+	// consumed tracks which declConfigs entries have already been matched to
+	// a required provider instance slot, so that the type-compatible
+	// fallback search below can't let a single "providers" argument
+	// assignment silently satisfy two distinct required slots that happen
+	// to share both an alias and a provider type.
+	consumed := make(map[addrs.LocalProviderConfig]bool, len(declConfigs))
+
 	for _, inCalleeAddr := range neededProviders {
 		typeAddr := inCalleeAddr.Provider
 		localName, ok := stackConfig.ProviderLocalName(ctx, typeAddr)
@@ -330,7 +569,25 @@ func (c *ComponentConfig) CheckProviders(ctx context.Context, phase EvalPhase) (
 			LocalName: localName,
 			Alias:     inCalleeAddr.Alias,
 		}
-		if _, exists := declConfigs[localAddr]; !exists {
+		matchedAddr, declExpr, ambiguous, exists := matchProviderConfig(
+			declConfigs, consumed, localAddr, typeAddr,
+			func(expr hcl.Expression) (addrs.Provider, tfdiags.Diagnostics) {
+				return c.providerTypeForConfigRef(ctx, stackConfig, expr)
+			},
+		)
+		if ambiguous {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Ambiguous provider configuration assignment",
+				Detail: fmt.Sprintf(
+					"More than one entry in this component's \"providers\" argument is type-compatible with the required provider configuration named %q for provider %q, and none of them is named %q explicitly.\n\nAssign this slot explicitly by using %q as the key in the \"providers\" argument.",
+					localAddr.StringCompact(), typeAddr.ForDisplay(), localAddr.StringCompact(), localAddr.StringCompact(),
+				),
+				Subject: c.Declaration(ctx).DeclRange.ToHCL().Ptr(),
+			})
+			continue
+		}
+		if !exists {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
 				Summary:  "Missing required provider configuration",
@@ -343,34 +600,161 @@ func (c *ComponentConfig) CheckProviders(ctx context.Context, phase EvalPhase) (
 			continue
 		}
 
-		// TODO: It's not currently possible to assign a provider configuration
-		//  with a different local name even if the types match. Find out if
-		//  this is deliberate. Note, the component_instance CheckProviders
-		//  function also enforces this.
-		//
-		// In theory you should be able to do this:
-		//   provider_one = provider.provider_two.default
-		//
-		// Assuming the underlying types of the providers are the same, even if
-		// the local names are not. This is not possible at the moment, the
-		// local names must match up.
-		//
-		// We'll have to partially parse the reference here to get the local
-		// configuration block (uninstanced), and then resolve the underlying
-		// type. And then make sure it matches the type of the provider we're
-		// assigning it to in the module. Also, we should fix the equivalent
-		// function in component_instance at the same time.
+		gotType, moreDiags := c.providerTypeForConfigRef(ctx, stackConfig, declExpr)
+		diags = diags.Append(moreDiags)
+		if moreDiags.HasErrors() {
+			continue
+		}
+		if gotType != typeAddr {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting provider type in \"providers\" argument",
+				Detail: fmt.Sprintf(
+					"The root module for %s requires a provider configuration for %q assigned to %q, but the given expression refers to a configuration for %q instead.",
+					c.Addr(), typeAddr.ForDisplay(), localAddr.StringCompact(), gotType.ForDisplay(),
+				),
+				Subject: declExpr.Range().Ptr(),
+			})
+			continue
+		}
+
+		consumed[matchedAddr] = true
 
 		ret.Add(inCalleeAddr)
 	}
 	return ret, diags
 }
 
+// providerTypeForConfigRef partially evaluates an expression from a
+// component's "providers" argument just enough to discover which
+// stack-level provider configuration block it refers to, and returns that
+// block's underlying provider type.
+//
+// This intentionally doesn't fully evaluate the expression, because during
+// static checks like this one the stack configuration might not yet have
+// enough information available to produce a real value; we only need the
+// static reference target, which is available even in that case.
+func (c *ComponentConfig) providerTypeForConfigRef(ctx context.Context, stackConfig *StackConfig, expr hcl.Expression) (addrs.Provider, tfdiags.Diagnostics) {
+	var diags tfdiags.Diagnostics
+
+	traversal, hclDiags := hcl.AbsTraversalForExpr(expr)
+	if hclDiags.HasErrors() {
+		diags = diags.Append(hclDiags)
+		return addrs.Provider{}, diags
+	}
+	ref, moreDiags := stackaddrs.ParseProviderConfigRef(traversal)
+	diags = diags.Append(moreDiags)
+	if moreDiags.HasErrors() {
+		return addrs.Provider{}, diags
+	}
+
+	sourceAddr, ok := stackConfig.ProviderForLocalName(ctx, ref.ProviderLocalName)
+	if !ok {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Reference to undeclared provider",
+			Detail:   fmt.Sprintf("There is no provider %q declared in this stack's required_providers block.", ref.ProviderLocalName),
+			Subject:  expr.Range().Ptr(),
+		})
+		return addrs.Provider{}, diags
+	}
+	return sourceAddr, diags
+}
+
+// matchProviderConfig resolves the "providers" argument expression that
+// satisfies a required provider instance slot's local address, either by an
+// exact match on declConfigs or, failing that, by falling back to scanning
+// declConfigs for a same-alias entry whose expression resolves (via typeOf)
+// to a compatible provider type.
+//
+// consumed marks entries already matched to some other required slot so
+// that they're skipped here, ensuring a single "providers" argument
+// assignment can't be used to satisfy two distinct required slots just
+// because they happen to share an alias and provider type.
+//
+// The fallback scan considers every candidate in declConfigs rather than
+// stopping at the first type-compatible one, sorting candidates by their
+// string representation first so that the outcome doesn't depend on Go's
+// randomized map iteration order; if more than one candidate qualifies,
+// that's reported back as ambiguous instead of arbitrarily picking one, so
+// that validate, plan, and apply can't disagree about which provider
+// instance satisfies the slot.
+//
+// It returns the LocalProviderConfig that was actually matched (which the
+// caller should add to consumed once it's confirmed the match is usable),
+// the matching expression, whether the fallback scan found more than one
+// equally-valid candidate, and whether a single match was found at all.
+func matchProviderConfig(
+	declConfigs map[addrs.LocalProviderConfig]hcl.Expression,
+	consumed map[addrs.LocalProviderConfig]bool,
+	localAddr addrs.LocalProviderConfig,
+	wantType addrs.Provider,
+	typeOf func(expr hcl.Expression) (addrs.Provider, tfdiags.Diagnostics),
+) (matchedAddr addrs.LocalProviderConfig, matchedExpr hcl.Expression, ambiguous bool, ok bool) {
+	if expr, ok := declConfigs[localAddr]; ok && !consumed[localAddr] {
+		return localAddr, expr, false, true
+	}
+
+	// The assignment might still be valid if it was written using a
+	// different local name than the one this stack configuration happens to
+	// have chosen for the provider's type, e.g.
+	//
+	//   provider_one = provider.provider_two.default
+	//
+	// as long as provider_one and provider_two both ultimately refer to the
+	// same provider type. We'll scan the other entries with a matching
+	// alias for a type-compatible match before concluding that nothing was
+	// assigned at all.
+	var candidateAddrs []addrs.LocalProviderConfig
+	for candidateAddr := range declConfigs {
+		if consumed[candidateAddr] || candidateAddr.Alias != localAddr.Alias {
+			continue
+		}
+		candidateAddrs = append(candidateAddrs, candidateAddr)
+	}
+	sort.Slice(candidateAddrs, func(i, j int) bool {
+		return candidateAddrs[i].String() < candidateAddrs[j].String()
+	})
+
+	var foundAddr addrs.LocalProviderConfig
+	var foundExpr hcl.Expression
+	matches := 0
+	for _, candidateAddr := range candidateAddrs {
+		candidateExpr := declConfigs[candidateAddr]
+		candidateType, diags := typeOf(candidateExpr)
+		if diags.HasErrors() {
+			continue
+		}
+		if candidateType != wantType {
+			continue
+		}
+		matches++
+		if matches == 1 {
+			foundAddr, foundExpr = candidateAddr, candidateExpr
+		}
+	}
+	switch matches {
+	case 0:
+		return addrs.LocalProviderConfig{}, nil, false, false
+	case 1:
+		return foundAddr, foundExpr, false, true
+	default:
+		return addrs.LocalProviderConfig{}, nil, true, false
+	}
+}
+
 func (c *ComponentConfig) neededProviderClients(ctx context.Context, phase EvalPhase) (map[addrs.RootProviderConfig]providers.Interface, bool) {
+	return c.neededProviderClientsForModuleTree(ctx, c.ModuleTree(ctx), phase)
+}
+
+// neededProviderClientsForModuleTree is the shared implementation of
+// [ComponentConfig.neededProviderClients], taking an explicit module tree
+// for the same reason as [ComponentConfig.requiredProviderInstancesForModuleTree].
+func (c *ComponentConfig) neededProviderClientsForModuleTree(ctx context.Context, moduleTree *configs.Config, phase EvalPhase) (map[addrs.RootProviderConfig]providers.Interface, bool) {
 	insts := make(map[addrs.RootProviderConfig]providers.Interface)
 	valid := true
 
-	providers, _ := c.CheckProviders(ctx, phase)
+	providers, _ := c.checkProvidersForModuleTree(ctx, moduleTree, phase)
 	for _, provider := range providers {
 		pTy := c.main.ProviderType(ctx, provider.Provider)
 		if pTy == nil {
@@ -391,9 +775,15 @@ func (c *ComponentConfig) neededProviderClients(ctx context.Context, phase EvalP
 }
 
 func (c *ComponentConfig) neededProviderSchemas(ctx context.Context, phase EvalPhase) (map[addrs.Provider]providers.ProviderSchema, tfdiags.Diagnostics) {
+	return c.neededProviderSchemasForModuleTree(ctx, c.ModuleTree(ctx), phase)
+}
+
+// neededProviderSchemasForModuleTree is the shared implementation of
+// [ComponentConfig.neededProviderSchemas], taking an explicit module tree
+// for the same reason as [ComponentConfig.requiredProviderInstancesForModuleTree].
+func (c *ComponentConfig) neededProviderSchemasForModuleTree(ctx context.Context, config *configs.Config, phase EvalPhase) (map[addrs.Provider]providers.ProviderSchema, tfdiags.Diagnostics) {
 	var diags tfdiags.Diagnostics
 
-	config := c.ModuleTree(ctx)
 	decl := c.Declaration(ctx)
 
 	providerSchemas := make(map[addrs.Provider]providers.ProviderSchema)
@@ -527,6 +917,10 @@ func (c *ComponentConfig) Validate(ctx context.Context) tfdiags.Diagnostics {
 }
 
 // PlanChanges implements Plannable.
+//
+// This doesn't yet run the component's test suite as part of planning: doing
+// so needs a [stackplan.PlannedChange] variant for reporting test results,
+// which doesn't exist yet. See [ComponentConfig.TestResults].
 func (c *ComponentConfig) PlanChanges(ctx context.Context) ([]stackplan.PlannedChange, tfdiags.Diagnostics) {
 	return nil, c.checkValid(ctx, PlanPhase)
 }
@@ -540,6 +934,114 @@ func (c *ComponentConfig) tracingName() string {
 type sourceBundleModuleWalker struct {
 	sources *sourcebundle.Bundle
 	parser  *configs.Parser
+
+	// suppressDeprecationWarnings disables the warning diagnostics that
+	// would otherwise be generated when a registry module resolves to a
+	// version its publisher has marked as deprecated. CI pipelines that
+	// intentionally pin to an older, deprecated version can set this to
+	// avoid noisy build output.
+	suppressDeprecationWarnings bool
+
+	// ignoreRules overrides the ".terraformignore" rules that would
+	// otherwise be loaded from each local module directory, letting a
+	// caller supply its own rule set programmatically instead of relying
+	// on whatever ".terraformignore" file (if any) is present on disk.
+	ignoreRules *ignorefiles.Ruleset
+
+	// testDir, if non-empty, is the name of a subdirectory (relative to
+	// each resolved module's final source) in which to also look for
+	// "*.tftest.hcl" files, mirroring what [configs.Parser.LoadConfigDirWithTests]
+	// does for a traditional root module. This lets a registry or remote
+	// module's own test suite be discovered without unpacking the bundle,
+	// analogous to LoadConfigWithTests for on-disk configurations.
+	testDir string
+
+	// versionSelector decides which available version of a registry module
+	// to use. It defaults to [NewestInSetSelector], matching this walker's
+	// long-standing behavior.
+	versionSelector VersionSelector
+
+	// pinnedSources maps a module call's path (as produced by
+	// [addrs.Module.String]) to a final source address string already
+	// recorded in the bundle manifest for that call, such as
+	// "registry.terraform.io/hashicorp/consul/aws@1.2.3//submodule". When
+	// present, this lets us skip re-resolving a registry version against
+	// the (possibly since-drifted) set of versions embedded in the bundle.
+	pinnedSources map[string]string
+
+	// registryVersionsCache and registryDeprecationsCache memoize the
+	// results of querying the source bundle for a registry package's
+	// available versions and their deprecation metadata, so that resolving
+	// the same registry package for more than one module call doesn't run
+	// the same bundle query twice. A [VersionSelector] chooses among the
+	// candidates it's given and never queries the bundle itself.
+	registryVersionsCache     map[string]versions.List
+	registryDeprecationsCache map[string]map[string]*sourcebundle.RegistryVersionDeprecation
+}
+
+// SourceBundleModuleWalkerOption customizes the behavior of a
+// [sourceBundleModuleWalker] constructed with [newSourceBundleModuleWalker].
+type SourceBundleModuleWalkerOption func(*sourceBundleModuleWalker)
+
+// WithSuppressDeprecationWarnings disables the "deprecated module version"
+// warning diagnostics described in [sourceBundleModuleWalker.suppressDeprecationWarnings].
+func WithSuppressDeprecationWarnings(suppress bool) SourceBundleModuleWalkerOption {
+	return func(w *sourceBundleModuleWalker) {
+		w.suppressDeprecationWarnings = suppress
+	}
+}
+
+// WithIgnoreRules overrides the ".terraformignore" rules the walker would
+// otherwise load from disk for each local module directory it visits.
+func WithIgnoreRules(rules *ignorefiles.Ruleset) SourceBundleModuleWalkerOption {
+	return func(w *sourceBundleModuleWalker) {
+		w.ignoreRules = rules
+	}
+}
+
+// WithTestFiles enables discovery of "*.tftest.hcl" files under the given
+// subdirectory name (relative to each resolved module) as the walker loads
+// modules, so that a bundled registry or remote module's own test suite is
+// attached to the loaded [configs.Config] just as [configs.Parser.LoadConfigDirWithTests]
+// would attach it for an on-disk module.
+func WithTestFiles(testDir string) SourceBundleModuleWalkerOption {
+	return func(w *sourceBundleModuleWalker) {
+		w.testDir = testDir
+	}
+}
+
+// WithPinnedSources supplies a set of final source addresses that a bundle
+// manifest has already pinned for particular module calls, keyed by the
+// path of the module being loaded (as produced by [addrs.Module.String],
+// such as "module.child"). When a module call's path is present in this map,
+// the walker decodes the given final source directly via
+// [sourceaddrs.ParseFinalSource] instead of re-resolving it against the
+// bundle's registry version list.
+func WithPinnedSources(pinned map[string]string) SourceBundleModuleWalkerOption {
+	return func(w *sourceBundleModuleWalker) {
+		w.pinnedSources = pinned
+	}
+}
+
+// WithVersionSelector overrides the policy the walker uses to choose among
+// the versions of a registry module available in the source bundle. If not
+// given, the walker uses [NewestInSetSelector].
+func WithVersionSelector(selector VersionSelector) SourceBundleModuleWalkerOption {
+	return func(w *sourceBundleModuleWalker) {
+		w.versionSelector = selector
+	}
+}
+
+func newSourceBundleModuleWalker(sources *sourcebundle.Bundle, parser *configs.Parser, opts ...SourceBundleModuleWalkerOption) *sourceBundleModuleWalker {
+	w := &sourceBundleModuleWalker{
+		sources:         sources,
+		parser:          parser,
+		versionSelector: NewestInSetSelector{},
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
 }
 
 // LoadModule implements configs.ModuleWalker.
@@ -551,7 +1053,20 @@ func (w *sourceBundleModuleWalker) LoadModule(req *configs.ModuleRequest) (*conf
 	// version against what's in the bundle manifest. This should cause
 	// use to make the same decision that the source bundler made about
 	// which real package to use.
-	finalSourceAddr, err := w.finalSourceForModule(req.SourceAddr, &req.VersionConstraint.Required)
+	//
+	// If the manifest already pinned a final source for this exact module
+	// call then we trust it outright, rather than re-deriving it from the
+	// registry version list, so that a bundle built with pinned versions
+	// stays deterministic even if that version list later drifts.
+	var finalSourceAddr sourceaddrs.FinalSource
+	var err error
+	var moreDiags hcl.Diagnostics
+	if pinned, ok := w.pinnedSources[req.Path.String()]; ok {
+		finalSourceAddr, err = w.finalSourceFromManifest(pinned)
+	} else {
+		finalSourceAddr, moreDiags, err = w.finalSourceForModule(req.SourceAddr, &req.VersionConstraint.Required, req.SourceAddrRange)
+	}
+	diags = append(diags, moreDiags...)
 	if err != nil {
 		// We should not typically get here because we're translating
 		// Terraform's own source address representations to the same
@@ -565,6 +1080,11 @@ func (w *sourceBundleModuleWalker) LoadModule(req *configs.ModuleRequest) (*conf
 		})
 		return nil, nil, diags
 	}
+	if diags.HasErrors() {
+		// finalSourceForModule can fail without also returning err, such as
+		// when its configured VersionSelector can't select a version.
+		return nil, nil, diags
+	}
 
 	moduleDir, err := w.sources.LocalPathForSource(finalSourceAddr)
 	if err != nil {
@@ -602,9 +1122,38 @@ func (w *sourceBundleModuleWalker) LoadModule(req *configs.ModuleRequest) (*conf
 		}
 	}
 
-	mod, moreDiags := w.parser.LoadConfigDir(moduleDir)
+	// For local module sources we honor ".terraformignore" semantics so
+	// that files excluded from module packaging are also excluded from
+	// parsing here, rather than being silently included just because the
+	// source bundle happens to still contain them on disk.
+	parser := w.parser
+	if _, ok := req.SourceAddr.(addrs.ModuleSourceLocal); ok {
+		rules, ruleErr := w.ignoreRulesForDir(moduleDir)
+		if ruleErr != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Can't load module for component",
+				Detail:   fmt.Sprintf("Failed to read .terraformignore for module %s: %s.", req.Path.String(), tfdiags.FormatError(ruleErr)),
+				Subject:  req.SourceAddrRange.Ptr(),
+			})
+			return nil, nil, diags
+		}
+		parser = configs.NewParser(&ignoreFilteredFs{Fs: afero.NewOsFs(), root: moduleDir, rules: rules})
+	}
+
+	mod, moreDiags := parser.LoadConfigDir(moduleDir)
 	diags = append(diags, moreDiags...)
 
+	if mod != nil && w.testDir != "" {
+		// Test files live alongside the module's other files within the
+		// same resolved final source, whether that source is local,
+		// remote, or a registry package, so no additional source
+		// resolution is needed beyond the moduleDir we already have.
+		testSuite, moreDiags := parser.LoadTestSuiteForModule(moduleDir, w.testDir, mod)
+		diags = append(diags, moreDiags...)
+		mod.Tests = testSuite
+	}
+
 	// Annoyingly we now need to translate our version selection back into
 	// the legacy type again, so we can return it through the ModuleWalker API.
 	var legacyV *version.Version
@@ -626,19 +1175,21 @@ func (w *sourceBundleModuleWalker) LoadModule(req *configs.ModuleRequest) (*conf
 	return mod, legacyV, diags
 }
 
-func (w *sourceBundleModuleWalker) finalSourceForModule(tfSourceAddr addrs.ModuleSource, versionConstraints *version.Constraints) (sourceaddrs.FinalSource, error) {
+func (w *sourceBundleModuleWalker) finalSourceForModule(tfSourceAddr addrs.ModuleSource, versionConstraints *version.Constraints, declRange hcl.Range) (sourceaddrs.FinalSource, hcl.Diagnostics, error) {
+	var diags hcl.Diagnostics
+
 	// Unfortunately the configs package still uses our old model of version
 	// constraints and Terraform's own form of source addresses, so we need
 	// to adapt to what the sourcebundle API is expecting.
 	sourceAddr, err := w.bundleSourceAddrForTerraformSourceAddr(tfSourceAddr)
 	if err != nil {
-		return nil, err
+		return nil, diags, err
 	}
 	var allowedVersions versions.Set
 	if versionConstraints != nil {
 		allowedVersions, err = w.versionSetForLegacyVersionConstraints(versionConstraints)
 		if err != nil {
-			return nil, fmt.Errorf("invalid version constraints: %w", err)
+			return nil, diags, fmt.Errorf("invalid version constraints: %w", err)
 		}
 	} else {
 		allowedVersions = versions.Released
@@ -646,21 +1197,161 @@ func (w *sourceBundleModuleWalker) finalSourceForModule(tfSourceAddr addrs.Modul
 
 	switch sourceAddr := sourceAddr.(type) {
 	case sourceaddrs.FinalSource:
-		// Most source address types are already final source addresses.
-		return sourceAddr, nil
+		// Local and remote sources parse directly to a final source address,
+		// with no registry version to resolve, so we can return them as-is
+		// without consulting allowedVersions at all.
+		return sourceAddr, diags, nil
 	case sourceaddrs.RegistrySource:
 		// Registry sources are trickier because we need to figure out which
-		// exact version we're using.
-		vs := w.sources.RegistryPackageVersions(sourceAddr.Package())
-		v := vs.NewestInSet(allowedVersions)
-		return sourceAddr.Versioned(v), nil
+		// exact version we're using. Which version that is, and whether we
+		// prefer a deprecated version over a non-deprecated one, a pinned
+		// one, etc, is up to the walker's configured VersionSelector.
+		pkg := sourceAddr.Package()
+		candidates := w.cachedRegistryPackageVersions(pkg)
+		deprecations := w.cachedRegistryPackageDeprecations(pkg, candidates)
+		v, selectDiags := w.versionSelector.SelectVersion(pkg, candidates, allowedVersions, deprecations)
+		diags = append(diags, selectDiags...)
+		diags = append(diags, w.deprecationWarningForVersion(v, deprecations, declRange)...)
+		return sourceAddr.Versioned(v), diags, nil
 	default:
 		// Should not get here because the above should be exhaustive for all
 		// possible address types.
-		return nil, fmt.Errorf("unsupported source address type %T", tfSourceAddr)
+		return nil, diags, fmt.Errorf("unsupported source address type %T", tfSourceAddr)
 	}
 }
 
+// finalSourceFromManifest decodes a final source address string that a
+// bundle manifest has already pinned for a particular module call, such as
+// "registry.terraform.io/hashicorp/consul/aws@1.2.3//submodule". This is a
+// fast path that skips the version-set recomputation that
+// [sourceBundleModuleWalker.finalSourceForModule] otherwise performs for a
+// registry source.
+func (w *sourceBundleModuleWalker) finalSourceFromManifest(addr string) (sourceaddrs.FinalSource, error) {
+	return sourceaddrs.ParseFinalSource(addr)
+}
+
+// ignoreRulesForDir returns the ".terraformignore" ruleset that applies to
+// files in the given local module directory, preferring an override
+// installed via [WithIgnoreRules] over whatever ".terraformignore" file (if
+// any) is actually present in the directory.
+func (w *sourceBundleModuleWalker) ignoreRulesForDir(dir string) (*ignorefiles.Ruleset, error) {
+	if w.ignoreRules != nil {
+		return w.ignoreRules, nil
+	}
+	return ignorefiles.LoadRulesFile(filepath.Join(dir, ".terraformignore"))
+}
+
+// ignoreFilteredFs is an afero.Fs decorator that hides directory entries
+// matched by a [ignorefiles.Ruleset], so that a [configs.Parser] built
+// against it never sees files or subdirectories excluded by
+// ".terraformignore" rules.
+//
+// root is the module directory that ".terraformignore" patterns are
+// anchored to; [ignorefiles.Ruleset.Excludes] expects root-relative paths,
+// so ignoreFilteredFile tracks each open directory's path relative to root
+// in order to build those paths correctly, rather than passing bare
+// filenames that would prevent anchored and multi-segment patterns from
+// ever matching.
+type ignoreFilteredFs struct {
+	afero.Fs
+	root  string
+	rules *ignorefiles.Ruleset
+}
+
+// Open implements afero.Fs.
+func (fs *ignoreFilteredFs) Open(name string) (afero.File, error) {
+	f, err := fs.Fs.Open(name)
+	if err != nil {
+		return f, err
+	}
+	relDir, err := filepath.Rel(fs.root, name)
+	if err != nil {
+		// filepath.Rel only fails when name can't be expressed relative to
+		// root at all (such as when one is absolute and the other is not),
+		// which should not happen because the parser opens paths built from
+		// root. If it somehow does, we'll fall back to treating name as the
+		// root itself so that we still filter by bare filename rather than
+		// failing outright.
+		relDir = "."
+	}
+	return &ignoreFilteredFile{File: f, rules: fs.rules, relDir: filepath.ToSlash(relDir)}, nil
+}
+
+type ignoreFilteredFile struct {
+	afero.File
+	rules *ignorefiles.Ruleset
+
+	// relDir is this directory's path relative to the ignoreFilteredFs's
+	// root, in slash-separated form, or "." for the root itself.
+	relDir string
+}
+
+// Readdir implements afero.File.
+func (f *ignoreFilteredFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	if err != nil {
+		return infos, err
+	}
+	kept := infos[:0]
+	for _, info := range infos {
+		childPath := info.Name()
+		if f.relDir != "." {
+			childPath = f.relDir + "/" + childPath
+		}
+		if f.rules.Excludes(childPath, info.IsDir()) {
+			continue
+		}
+		kept = append(kept, info)
+	}
+	return kept, nil
+}
+
+// Readdirnames implements afero.File.
+func (f *ignoreFilteredFile) Readdirnames(count int) ([]string, error) {
+	infos, err := f.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, nil
+}
+
+// deprecationWarningForVersion returns a warning diagnostic if deprecations
+// records that the selected version was marked as deprecated by its
+// publisher, or no diagnostics at all if the version is not deprecated or
+// deprecation warnings have been suppressed.
+func (w *sourceBundleModuleWalker) deprecationWarningForVersion(v versions.Version, deprecations map[string]*sourcebundle.RegistryVersionDeprecation, declRange hcl.Range) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+
+	if w.suppressDeprecationWarnings {
+		return diags
+	}
+
+	dep := deprecations[v.String()]
+	if dep == nil {
+		return diags
+	}
+
+	detail := fmt.Sprintf("Version %s of this module is deprecated: %s", v, dep.Reason)
+	if dep.Link != "" {
+		detail += fmt.Sprintf("\n\nSee %s for more information.", dep.Link)
+	}
+	if !dep.EffectiveDate.IsZero() {
+		detail += fmt.Sprintf("\n\nThis deprecation took effect on %s.", dep.EffectiveDate.Format("2006-01-02"))
+	}
+
+	diags = append(diags, &hcl.Diagnostic{
+		Severity: hcl.DiagWarning,
+		Summary:  "Deprecated module version",
+		Detail:   detail,
+		Subject:  declRange.Ptr(),
+	})
+	return diags
+}
+
 func (w *sourceBundleModuleWalker) bundleSourceAddrForTerraformSourceAddr(tfSourceAddr addrs.ModuleSource) (sourceaddrs.Source, error) {
 	// In practice this should always succeed because the source bundle builder
 	// would've parsed the same source addresses using these same parsers
@@ -691,3 +1382,126 @@ func (w *sourceBundleModuleWalker) versionSetForLegacyVersionConstraints(version
 func (w *sourceBundleModuleWalker) legacyVersionForVersion(v versions.Version) (*version.Version, error) {
 	return version.NewVersion(v.String())
 }
+
+// cachedRegistryPackageVersions returns the versions available for pkg in
+// the source bundle, memoizing the result so that repeated resolutions of
+// the same package (for example, from several module calls that all use
+// that package) don't repeat the underlying bundle query.
+func (w *sourceBundleModuleWalker) cachedRegistryPackageVersions(pkg sourceaddrs.RegistryPackage) versions.List {
+	key := pkg.String()
+	if vs, ok := w.registryVersionsCache[key]; ok {
+		return vs
+	}
+	vs := w.sources.RegistryPackageVersions(pkg)
+	if w.registryVersionsCache == nil {
+		w.registryVersionsCache = make(map[string]versions.List)
+	}
+	w.registryVersionsCache[key] = vs
+	return vs
+}
+
+// cachedRegistryPackageDeprecations returns the deprecation metadata for
+// each of pkg's candidate versions, keyed by version string, memoizing the
+// result for the same reason as [sourceBundleModuleWalker.cachedRegistryPackageVersions].
+func (w *sourceBundleModuleWalker) cachedRegistryPackageDeprecations(pkg sourceaddrs.RegistryPackage, candidates versions.List) map[string]*sourcebundle.RegistryVersionDeprecation {
+	key := pkg.String()
+	if deps, ok := w.registryDeprecationsCache[key]; ok {
+		return deps
+	}
+	deps := make(map[string]*sourcebundle.RegistryVersionDeprecation, len(candidates))
+	for _, v := range candidates {
+		if dep := w.sources.RegistryPackageVersionDeprecation(pkg, v); dep != nil {
+			deps[v.String()] = dep
+		}
+	}
+	if w.registryDeprecationsCache == nil {
+		w.registryDeprecationsCache = make(map[string]map[string]*sourcebundle.RegistryVersionDeprecation)
+	}
+	w.registryDeprecationsCache[key] = deps
+	return deps
+}
+
+// VersionSelector implements a policy for choosing which available version
+// of a registry module a [sourceBundleModuleWalker] should use.
+//
+// candidates is the full set of versions the source bundle has a package
+// for, allowed is the version set produced from the calling module's
+// version constraint, and deprecations records the deprecation metadata (if
+// any) the bundle has for each of candidates, keyed by version string.
+//
+// Implementations may return diagnostics alongside the chosen version, such
+// as a warning that no version satisfying the caller's preferences was
+// available and a less-preferred one was used instead.
+type VersionSelector interface {
+	SelectVersion(pkg sourceaddrs.RegistryPackage, candidates versions.List, allowed versions.Set, deprecations map[string]*sourcebundle.RegistryVersionDeprecation) (versions.Version, hcl.Diagnostics)
+}
+
+// NewestInSetSelector selects the newest candidate version that satisfies
+// the caller's version constraint, without regard to deprecation status.
+// This is the walker's original, long-standing behavior.
+type NewestInSetSelector struct{}
+
+// SelectVersion implements VersionSelector.
+func (NewestInSetSelector) SelectVersion(pkg sourceaddrs.RegistryPackage, candidates versions.List, allowed versions.Set, deprecations map[string]*sourcebundle.RegistryVersionDeprecation) (versions.Version, hcl.Diagnostics) {
+	return candidates.NewestInSet(allowed), nil
+}
+
+// NewestNonDeprecatedSelector selects the newest candidate version that
+// satisfies the caller's version constraint and that the bundle doesn't
+// record as deprecated. If every version satisfying the constraint is
+// deprecated, it falls back to the newest matching version overall; the
+// caller finds out about that fallback via the usual deprecation warning
+// that [sourceBundleModuleWalker] attaches to the chosen version.
+type NewestNonDeprecatedSelector struct{}
+
+// SelectVersion implements VersionSelector.
+func (NewestNonDeprecatedSelector) SelectVersion(pkg sourceaddrs.RegistryPackage, candidates versions.List, allowed versions.Set, deprecations map[string]*sourcebundle.RegistryVersionDeprecation) (versions.Version, hcl.Diagnostics) {
+	nonDeprecated := make(versions.List, 0, len(candidates))
+	for _, v := range candidates {
+		if deprecations[v.String()] == nil {
+			nonDeprecated = append(nonDeprecated, v)
+		}
+	}
+	if len(nonDeprecated) > 0 {
+		if v := nonDeprecated.NewestInSet(allowed); v != (versions.Version{}) {
+			return v, nil
+		}
+	}
+	return candidates.NewestInSet(allowed), nil
+}
+
+// LockfilePinnedSelector selects whatever version a dependency lock file
+// already pinned for a registry package, ignoring the caller's version
+// constraint and the newest-available heuristics that the other selectors
+// use, and erroring out if the bundle doesn't have that exact version.
+type LockfilePinnedSelector struct {
+	// Pins maps a registry package (identified by [sourceaddrs.RegistryPackage.String])
+	// to the version a dependency lock file pinned for it.
+	Pins map[string]versions.Version
+}
+
+// SelectVersion implements VersionSelector.
+func (s LockfilePinnedSelector) SelectVersion(pkg sourceaddrs.RegistryPackage, candidates versions.List, allowed versions.Set, deprecations map[string]*sourcebundle.RegistryVersionDeprecation) (versions.Version, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	pinned, ok := s.Pins[pkg.String()]
+	if !ok {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "No dependency lock file entry for module",
+			Detail:   fmt.Sprintf("There is no dependency lock file entry pinning a version of %s.", pkg.ForDisplay()),
+		})
+		return versions.Version{}, diags
+	}
+	for _, v := range candidates {
+		if v == pinned {
+			return v, diags
+		}
+	}
+	diags = diags.Append(&hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Locked module version not available",
+		Detail:   fmt.Sprintf("The dependency lock file pins %s to version %s, but the source bundle doesn't contain that version.", pkg.ForDisplay(), pinned),
+	})
+	return versions.Version{}, diags
+}
@@ -0,0 +1,345 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: BUSL-1.1
+
+package stackeval
+
+import (
+	"testing"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/hashicorp/go-slug/sourceaddrs"
+	"github.com/hashicorp/go-slug/sourcebundle"
+	"github.com/hashicorp/hcl/v2"
+
+	"github.com/hashicorp/terraform/internal/addrs"
+	"github.com/hashicorp/terraform/internal/tfdiags"
+)
+
+// fakeProviderExpr is a placeholder hcl.Expression used only as a map value
+// in these tests; matchProviderConfig never evaluates it directly, it only
+// passes it to the typeOf callback and returns it unchanged.
+type fakeProviderExpr struct {
+	hcl.Expression
+	label string
+}
+
+func TestMatchProviderConfig(t *testing.T) {
+	awsProvider := addrs.NewDefaultProvider("aws")
+	azureProvider := addrs.NewDefaultProvider("azurerm")
+
+	typeOf := func(types map[hcl.Expression]addrs.Provider) func(hcl.Expression) (addrs.Provider, tfdiags.Diagnostics) {
+		return func(expr hcl.Expression) (addrs.Provider, tfdiags.Diagnostics) {
+			if ty, ok := types[expr]; ok {
+				return ty, nil
+			}
+			var diags tfdiags.Diagnostics
+			diags = diags.Append(tfdiags.Sourceless(tfdiags.Error, "no such expression", "unexpected expression in test"))
+			return addrs.Provider{}, diags
+		}
+	}
+
+	t.Run("exact match by local name", func(t *testing.T) {
+		exprA := &fakeProviderExpr{label: "a"}
+		declConfigs := map[addrs.LocalProviderConfig]hcl.Expression{
+			{LocalName: "aws"}: exprA,
+		}
+		types := map[hcl.Expression]addrs.Provider{exprA: awsProvider}
+
+		matchedAddr, expr, ambiguous, ok := matchProviderConfig(
+			declConfigs, map[addrs.LocalProviderConfig]bool{},
+			addrs.LocalProviderConfig{LocalName: "aws"}, awsProvider,
+			typeOf(types),
+		)
+		if !ok {
+			t.Fatal("expected a match")
+		}
+		if ambiguous {
+			t.Error("did not expect an ambiguous result")
+		}
+		if expr != hcl.Expression(exprA) {
+			t.Errorf("wrong expression matched")
+		}
+		if matchedAddr.LocalName != "aws" {
+			t.Errorf("wrong local addr matched: %#v", matchedAddr)
+		}
+	})
+
+	t.Run("fallback match by type when local names differ", func(t *testing.T) {
+		exprB := &fakeProviderExpr{label: "b"}
+		declConfigs := map[addrs.LocalProviderConfig]hcl.Expression{
+			{LocalName: "provider_two"}: exprB,
+		}
+		types := map[hcl.Expression]addrs.Provider{exprB: awsProvider}
+
+		matchedAddr, expr, ambiguous, ok := matchProviderConfig(
+			declConfigs, map[addrs.LocalProviderConfig]bool{},
+			addrs.LocalProviderConfig{LocalName: "provider_one"}, awsProvider,
+			typeOf(types),
+		)
+		if !ok {
+			t.Fatal("expected a fallback match")
+		}
+		if ambiguous {
+			t.Error("did not expect an ambiguous result")
+		}
+		if expr != hcl.Expression(exprB) {
+			t.Errorf("wrong expression matched")
+		}
+		if matchedAddr.LocalName != "provider_two" {
+			t.Errorf("expected fallback to match provider_two, got %#v", matchedAddr)
+		}
+	})
+
+	t.Run("no match when types are incompatible", func(t *testing.T) {
+		exprC := &fakeProviderExpr{label: "c"}
+		declConfigs := map[addrs.LocalProviderConfig]hcl.Expression{
+			{LocalName: "provider_two"}: exprC,
+		}
+		types := map[hcl.Expression]addrs.Provider{exprC: azureProvider}
+
+		_, _, ambiguous, ok := matchProviderConfig(
+			declConfigs, map[addrs.LocalProviderConfig]bool{},
+			addrs.LocalProviderConfig{LocalName: "provider_one"}, awsProvider,
+			typeOf(types),
+		)
+		if ok {
+			t.Fatal("expected no match for a type-incompatible candidate")
+		}
+		if ambiguous {
+			t.Error("did not expect an ambiguous result")
+		}
+	})
+
+	t.Run("ambiguous fallback match is reported rather than picked arbitrarily", func(t *testing.T) {
+		exprE := &fakeProviderExpr{label: "e"}
+		exprF := &fakeProviderExpr{label: "f"}
+		declConfigs := map[addrs.LocalProviderConfig]hcl.Expression{
+			{LocalName: "foo", Alias: "one"}: exprE,
+			{LocalName: "bar", Alias: "one"}: exprF,
+		}
+		types := map[hcl.Expression]addrs.Provider{
+			exprE: awsProvider,
+			exprF: awsProvider,
+		}
+
+		// Run several times to make sure the result doesn't depend on map
+		// iteration order, which Go deliberately randomizes.
+		for i := 0; i < 10; i++ {
+			_, _, ambiguous, ok := matchProviderConfig(
+				declConfigs, map[addrs.LocalProviderConfig]bool{},
+				addrs.LocalProviderConfig{LocalName: "provider_one", Alias: "one"}, awsProvider,
+				typeOf(types),
+			)
+			if ok {
+				t.Fatal("expected an ambiguous result rather than a match")
+			}
+			if !ambiguous {
+				t.Fatal("expected the two equally-valid candidates to be reported as ambiguous")
+			}
+		}
+	})
+
+	t.Run("aliased instances are not reused across distinct callee slots", func(t *testing.T) {
+		exprD := &fakeProviderExpr{label: "d"}
+		declConfigs := map[addrs.LocalProviderConfig]hcl.Expression{
+			{LocalName: "provider_two", Alias: "one"}: exprD,
+		}
+		types := map[hcl.Expression]addrs.Provider{exprD: awsProvider}
+		consumed := map[addrs.LocalProviderConfig]bool{}
+
+		// The first required slot (with a different local name than the
+		// declared one) matches via the type-compatible fallback.
+		matchedAddr, _, _, ok := matchProviderConfig(
+			declConfigs, consumed,
+			addrs.LocalProviderConfig{LocalName: "provider_one", Alias: "one"}, awsProvider,
+			typeOf(types),
+		)
+		if !ok {
+			t.Fatal("expected the first slot to match")
+		}
+		consumed[matchedAddr] = true
+
+		// A second, distinct required slot with the same alias and type
+		// must not be satisfied by the same already-consumed declaration.
+		_, _, _, ok = matchProviderConfig(
+			declConfigs, consumed,
+			addrs.LocalProviderConfig{LocalName: "provider_three", Alias: "one"}, awsProvider,
+			typeOf(types),
+		)
+		if ok {
+			t.Fatal("expected the second slot to be unmatched because its only candidate was already consumed")
+		}
+	})
+}
+
+func mustParseVersion(t *testing.T, s string) versions.Version {
+	t.Helper()
+	v, err := versions.ParseVersion(s)
+	if err != nil {
+		t.Fatalf("failed to parse %q as a version: %s", s, err)
+	}
+	return v
+}
+
+func TestNewestNonDeprecatedSelector(t *testing.T) {
+	v1 := mustParseVersion(t, "1.0.0")
+	v2 := mustParseVersion(t, "2.0.0")
+	v3 := mustParseVersion(t, "3.0.0")
+	candidates := versions.List{v1, v2, v3}
+	pkg := sourceaddrs.RegistryPackage{}
+
+	t.Run("skips deprecated versions in favor of the newest non-deprecated one", func(t *testing.T) {
+		deprecations := map[string]*sourcebundle.RegistryVersionDeprecation{
+			v3.String(): {Reason: "deprecated"},
+		}
+		got, diags := NewestNonDeprecatedSelector{}.SelectVersion(pkg, candidates, versions.Released, deprecations)
+		if len(diags) != 0 {
+			t.Fatalf("unexpected diagnostics: %s", diags)
+		}
+		if got != v2 {
+			t.Errorf("got %s, want %s", got, v2)
+		}
+	})
+
+	t.Run("falls back to the newest overall when every candidate is deprecated", func(t *testing.T) {
+		deprecations := map[string]*sourcebundle.RegistryVersionDeprecation{
+			v1.String(): {Reason: "deprecated"},
+			v2.String(): {Reason: "deprecated"},
+			v3.String(): {Reason: "deprecated"},
+		}
+		got, diags := NewestNonDeprecatedSelector{}.SelectVersion(pkg, candidates, versions.Released, deprecations)
+		if len(diags) != 0 {
+			t.Fatalf("unexpected diagnostics: %s", diags)
+		}
+		if got != v3 {
+			t.Errorf("got %s, want %s", got, v3)
+		}
+	})
+}
+
+func TestLockfilePinnedSelector(t *testing.T) {
+	v1 := mustParseVersion(t, "1.0.0")
+	v2 := mustParseVersion(t, "2.0.0")
+	candidates := versions.List{v1, v2}
+	pkg := sourceaddrs.RegistryPackage{}
+
+	t.Run("selects the pinned version when available", func(t *testing.T) {
+		selector := LockfilePinnedSelector{Pins: map[string]versions.Version{pkg.String(): v1}}
+		got, diags := selector.SelectVersion(pkg, candidates, versions.Released, nil)
+		if len(diags) != 0 {
+			t.Fatalf("unexpected diagnostics: %s", diags)
+		}
+		if got != v1 {
+			t.Errorf("got %s, want %s", got, v1)
+		}
+	})
+
+	t.Run("errors when there's no pin for the package", func(t *testing.T) {
+		selector := LockfilePinnedSelector{Pins: map[string]versions.Version{}}
+		_, diags := selector.SelectVersion(pkg, candidates, versions.Released, nil)
+		if !diags.HasErrors() {
+			t.Fatal("expected an error for a package with no lock file pin")
+		}
+	})
+
+	t.Run("errors when the pinned version isn't in the bundle", func(t *testing.T) {
+		v9 := mustParseVersion(t, "9.0.0")
+		selector := LockfilePinnedSelector{Pins: map[string]versions.Version{pkg.String(): v9}}
+		_, diags := selector.SelectVersion(pkg, candidates, versions.Released, nil)
+		if !diags.HasErrors() {
+			t.Fatal("expected an error when the pinned version isn't among the bundle's candidates")
+		}
+	})
+}
+
+func TestSourceBundleModuleWalkerDeprecationWarningForVersion(t *testing.T) {
+	v, err := versions.ParseVersion("1.2.3")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	otherV, err := versions.ParseVersion("4.5.6")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	deprecations := map[string]*sourcebundle.RegistryVersionDeprecation{
+		"1.2.3": {Reason: "superseded by 2.0.0"},
+	}
+
+	t.Run("warns for a deprecated version", func(t *testing.T) {
+		w := &sourceBundleModuleWalker{}
+		diags := w.deprecationWarningForVersion(v, deprecations, hcl.Range{})
+		if len(diags) != 1 {
+			t.Fatalf("expected one diagnostic, got %d", len(diags))
+		}
+		if diags[0].Severity != hcl.DiagWarning {
+			t.Errorf("expected a warning, got %s", diags[0].Severity)
+		}
+	})
+
+	t.Run("suppressed when requested", func(t *testing.T) {
+		w := &sourceBundleModuleWalker{suppressDeprecationWarnings: true}
+		diags := w.deprecationWarningForVersion(v, deprecations, hcl.Range{})
+		if len(diags) != 0 {
+			t.Fatalf("expected no diagnostics when suppressed, got %d", len(diags))
+		}
+	})
+
+	t.Run("no warning for a non-deprecated version", func(t *testing.T) {
+		w := &sourceBundleModuleWalker{}
+		diags := w.deprecationWarningForVersion(otherV, deprecations, hcl.Range{})
+		if len(diags) != 0 {
+			t.Fatalf("expected no diagnostics for a non-deprecated version, got %d", len(diags))
+		}
+	})
+}
+
+func TestSourceBundleModuleWalkerFinalSourceFromManifest(t *testing.T) {
+	w := &sourceBundleModuleWalker{}
+
+	t.Run("versioned registry source", func(t *testing.T) {
+		got, err := w.finalSourceFromManifest("registry.terraform.io/hashicorp/consul/aws@1.2.3//submodule")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		want, err := sourceaddrs.ParseFinalSource("registry.terraform.io/hashicorp/consul/aws@1.2.3//submodule")
+		if err != nil {
+			t.Fatalf("unexpected error parsing expected value: %s", err)
+		}
+		if got.String() != want.String() {
+			t.Errorf("wrong result\ngot:  %s\nwant: %s", got, want)
+		}
+	})
+
+	t.Run("invalid address", func(t *testing.T) {
+		if _, err := w.finalSourceFromManifest("not a valid source address"); err == nil {
+			t.Fatal("expected an error for an invalid pinned source address")
+		}
+	})
+}
+
+func TestSourceBundleModuleWalkerPinnedSourcesOption(t *testing.T) {
+	pins := map[string]string{
+		"module.child": "registry.terraform.io/hashicorp/consul/aws@1.2.3",
+	}
+	w := &sourceBundleModuleWalker{}
+	WithPinnedSources(pins)(w)
+	if w.pinnedSources["module.child"] != pins["module.child"] {
+		t.Errorf("WithPinnedSources did not set pinnedSources: got %#v", w.pinnedSources)
+	}
+}
+
+func TestSourceBundleModuleWalkerTestFilesOption(t *testing.T) {
+	w := &sourceBundleModuleWalker{}
+	WithTestFiles("tests")(w)
+	if w.testDir != "tests" {
+		t.Errorf("WithTestFiles did not set testDir: got %q, want %q", w.testDir, "tests")
+	}
+
+	// The zero value (no option applied) must mean "don't look for test
+	// files", since that's what LoadModule uses to decide whether to call
+	// parser.LoadTestSuiteForModule at all.
+	w2 := &sourceBundleModuleWalker{}
+	if w2.testDir != "" {
+		t.Errorf("expected no test directory by default, got %q", w2.testDir)
+	}
+}